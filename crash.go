@@ -0,0 +1,14 @@
+package sshego
+
+// CrashHandler is invoked when one of shovel.Start's two goroutines
+// panics -- for example because a caller's custom LogReads/LogWrites
+// writer, wired in through io.TeeReader/io.MultiWriter, panics
+// mid-copy. label identifies which shovel direction panicked, r is the
+// recovered value, and stack is the stack trace captured at the point
+// of recovery. The default logs and lets the shovel report itself done,
+// so one misbehaving forwarded channel doesn't take down a long-running
+// SSH server with it. Override this to wire in your own crash
+// reporting; this mirrors the standard utilruntime.HandleCrash pattern.
+var CrashHandler = func(label string, r interface{}, stack []byte) {
+	p("shovel %s recovered from panic: %v\n%s", label, r, stack)
+}
@@ -0,0 +1,77 @@
+package sshego
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// panicWriter always panics on Write, simulating a misbehaving
+// LogWrites sink.
+type panicWriter struct{}
+
+func (panicWriter) Write(p []byte) (int, error) {
+	panic("panicWriter: boom")
+}
+
+// TestShovelCrashRecoverySignalsPeerAndMarksDone panics a LogWrites
+// sink mid-copy and checks all three guarantees this request makes:
+// CrashHandler fires with the panicking direction's label, that
+// direction's Halt still reaches done, and the peer direction is torn
+// down too instead of leaking a stuck goroutine.
+func TestShovelCrashRecoverySignalsPeerAndMarksDone(t *testing.T) {
+	orig := CrashHandler
+	var mu sync.Mutex
+	var gotLabel string
+	var gotPanic interface{}
+	CrashHandler = func(label string, r interface{}, stack []byte) {
+		mu.Lock()
+		gotLabel, gotPanic = label, r
+		mu.Unlock()
+	}
+	defer func() { CrashHandler = orig }()
+
+	aLocal, aRemote := net.Pipe()
+	bLocal, bRemote := net.Pipe()
+	defer aRemote.Close()
+	defer bRemote.Close()
+
+	pair := newShovelPair(true)
+	pair.AB.LogWrites = panicWriter{}
+	pair.Start(aLocal, bLocal, "ab", "ba")
+
+	// aRemote must be drained or net.Pipe's synchronous Write blocks
+	// forever before MultiWriter ever reaches the panicking LogWrites.
+	go io.Copy(io.Discard, aRemote)
+
+	go bRemote.Write([]byte("hi")) // AB copies b->a, so this feeds AB's panic
+
+	select {
+	case <-pair.Halt.DoneChan():
+	case <-time.After(2 * time.Second):
+		t.Fatal("pair did not reach done after a panic in one direction")
+	}
+
+	mu.Lock()
+	label, r := gotLabel, gotPanic
+	mu.Unlock()
+	if r == nil {
+		t.Fatal("expected CrashHandler to be invoked")
+	}
+	if label != "ab" {
+		t.Fatalf("expected the panicking direction's label %q, got %q", "ab", label)
+	}
+
+	select {
+	case <-pair.AB.Halt.DoneChan():
+	default:
+		t.Fatal("expected the panicking shovel's Halt to be marked done")
+	}
+	select {
+	case <-pair.BA.Halt.DoneChan():
+	default:
+		t.Fatal("expected the peer (BA) shovel to be signalled done too")
+	}
+}
@@ -0,0 +1,115 @@
+package sshego
+
+import (
+	"io"
+	"time"
+
+	yamux "github.com/glycerine/sshego/xendor/github.com/hashicorp/yamux"
+
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// MuxOptions configures the yamux session a MuxShovel wraps. The zero
+// value uses yamux's own defaults. The in-tree yamux session honours
+// only AcceptBacklog: KeepAliveInterval, ConnectionWriteTimeout and
+// DisableKeepAlive are copied into its Config, but it sends no
+// keepalive pings and puts no timeout on connection writes.
+type MuxOptions struct {
+	KeepAliveInterval      time.Duration
+	ConnectionWriteTimeout time.Duration
+	AcceptBacklog          int
+	DisableKeepAlive       bool
+}
+
+func (o *MuxOptions) toYamuxConfig() *yamux.Config {
+	cfg := yamux.DefaultConfig()
+	if o == nil {
+		return cfg
+	}
+	if o.KeepAliveInterval > 0 {
+		cfg.KeepAliveInterval = o.KeepAliveInterval
+	}
+	if o.ConnectionWriteTimeout > 0 {
+		cfg.ConnectionWriteTimeout = o.ConnectionWriteTimeout
+	}
+	if o.AcceptBacklog > 0 {
+		cfg.AcceptBacklog = o.AcceptBacklog
+	}
+	cfg.EnableKeepAlive = !o.DisableKeepAlive
+	return cfg
+}
+
+// MuxShovel multiplexes many logical bidirectional streams over a
+// single io.ReadWriteCloser -- typically one forwarded SSH channel --
+// using yamux (pure Go, no cgo, already relied on by hashicorp/plugin
+// and libp2p). Callers tunneling short-lived protocols (RPC, bursts of
+// HTTP/1.1 requests) can then open as many logical connections as they
+// like without paying SSH's per-channel open latency for each one.
+type MuxShovel struct {
+	Halt *ssh.Halter
+	sess *yamux.Session
+}
+
+// NewMuxShovel wraps conn in a yamux session. client must be true on
+// exactly one side of conn (conventionally whichever side initiated
+// the underlying SSH forward) and false on the other; yamux requires
+// the two ends to agree on which is which. opts may be nil to accept
+// yamux's defaults.
+func NewMuxShovel(conn io.ReadWriteCloser, client bool, opts *MuxOptions) (*MuxShovel, error) {
+	cfg := opts.toYamuxConfig()
+
+	var sess *yamux.Session
+	var err error
+	if client {
+		sess, err = yamux.Client(conn, cfg)
+	} else {
+		sess, err = yamux.Server(conn, cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := &MuxShovel{
+		Halt: ssh.NewHalter(),
+		sess: sess,
+	}
+	m.Halt.MarkReady()
+	go m.watchClose()
+	return m, nil
+}
+
+// OpenStream opens a new logical stream to the peer MuxShovel.
+func (m *MuxShovel) OpenStream() (io.ReadWriteCloser, error) {
+	return m.sess.Open()
+}
+
+// AcceptStream blocks until the peer MuxShovel opens a new logical
+// stream, or the session is closed.
+func (m *MuxShovel) AcceptStream() (io.ReadWriteCloser, error) {
+	return m.sess.Accept()
+}
+
+// NumStreams reports how many logical streams are currently open.
+func (m *MuxShovel) NumStreams() int {
+	return m.sess.NumStreams()
+}
+
+// Close tears down the session -- and every substream opened through
+// it -- and marks the halter done. It is safe to call more than once.
+func (m *MuxShovel) Close() error {
+	m.Halt.RequestStop()
+	<-m.Halt.DoneChan()
+	return nil
+}
+
+// watchClose marks the halter done once the session goes away, whether
+// that is because Close() requested it or because the peer (or the
+// underlying conn) closed the session on its own.
+func (m *MuxShovel) watchClose() {
+	defer m.Halt.MarkDone()
+	select {
+	case <-m.Halt.ReqStopChan():
+		m.sess.Close()
+	case <-m.sess.CloseChan():
+	}
+}
@@ -0,0 +1,86 @@
+package sshego
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestMuxShovelOpenAcceptRoundtripAndClose exercises the whole MuxShovel
+// API surface end to end: a client-side OpenStream matched by a
+// server-side AcceptStream, a write/read roundtrip over the resulting
+// stream, and Close tearing down every substream it opened.
+func TestMuxShovelOpenAcceptRoundtripAndClose(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+
+	clientMux, err := NewMuxShovel(clientConn, true, nil)
+	if err != nil {
+		t.Fatalf("client NewMuxShovel: %v", err)
+	}
+	serverMux, err := NewMuxShovel(serverConn, false, nil)
+	if err != nil {
+		t.Fatalf("server NewMuxShovel: %v", err)
+	}
+	defer serverMux.Close()
+
+	serverDone := make(chan error, 1)
+	go func() {
+		str, err := serverMux.AcceptStream()
+		if err != nil {
+			serverDone <- err
+			return
+		}
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(str, buf); err != nil {
+			serverDone <- err
+			return
+		}
+		if _, err := str.Write(buf); err != nil {
+			serverDone <- err
+			return
+		}
+		serverDone <- nil
+	}()
+
+	cstr, err := clientMux.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	if _, err := cstr.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(cstr, buf); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("expected the echoed payload back, got %q", buf)
+	}
+
+	select {
+	case err := <-serverDone:
+		if err != nil {
+			t.Fatalf("server side of the roundtrip failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("server side never finished the roundtrip")
+	}
+
+	if n := clientMux.NumStreams(); n != 1 {
+		t.Fatalf("expected 1 open stream before Close, got %d", n)
+	}
+
+	if err := clientMux.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if n := clientMux.NumStreams(); n != 0 {
+		t.Fatalf("expected Close to tear down open substreams, got %d still open", n)
+	}
+
+	if _, err := cstr.Write([]byte("x")); err == nil {
+		t.Fatal("expected a write on a substream to fail once Close has torn down the session")
+	}
+}
@@ -0,0 +1,234 @@
+package sshego
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+const (
+	defaultBackoffBase     = 500 * time.Millisecond
+	defaultBackoffCap      = 30 * time.Second
+	backoffJitterFrac      = 0.2
+	defaultMinConnDuration = 10 * time.Second
+)
+
+// BackoffState is a point-in-time snapshot of a PersistentShovelPair's
+// reconnect backoff, for callers that want to surface it on a status
+// page or as a metric.
+type BackoffState struct {
+	ConsecutiveFailures int
+	NextDelay           time.Duration
+	LastErr             error
+}
+
+// PersistentShovelPair supervises a shovelPair across reconnects. Every
+// time the underlying pair finishes -- the remote end hung up, a dial
+// failed, anything short of an explicit Stop() -- it redials both ends
+// and starts a fresh pair, backing off exponentially between attempts.
+// This is the retry loop an always-on reverse tunnel (autossh/chisel
+// style) needs around shovelPair.Start, built once instead of by every
+// caller.
+type PersistentShovelPair struct {
+	DialA func() (io.ReadWriteCloser, error)
+	DialB func() (io.ReadWriteCloser, error)
+
+	AbLabel string
+	BaLabel string
+
+	// DoLog and MaxWaitForSecondStream are forwarded to every shovelPair
+	// this supervisor creates.
+	DoLog                  bool
+	MaxWaitForSecondStream time.Duration
+
+	// BackoffBase and BackoffCap bound the truncated exponential backoff
+	// between reconnect attempts. Zero values fall back to 500ms / 30s.
+	BackoffBase time.Duration
+	BackoffCap  time.Duration
+
+	// MaxConsecutiveFailures stops the supervisor once dial or copy
+	// failures in a row, with no intervening success, exceed this many:
+	// it still retries after failure number MaxConsecutiveFailures and
+	// gives up on the next one. Zero means retry forever.
+	MaxConsecutiveFailures int
+
+	// MinConnDuration is how long a pair must stay up before it counts
+	// as a success that resets the backoff. A pair that finishes sooner
+	// than this -- remote reset, auth rejected, anything short of an
+	// explicit Stop() -- is treated as a failure, so a peer that accepts
+	// the dial but immediately drops the connection still backs off
+	// instead of reconnecting in a zero-delay loop. Zero falls back to
+	// 10s.
+	MinConnDuration time.Duration
+
+	Halt *ssh.Halter
+
+	mu      sync.Mutex
+	state   BackoffState
+	resetCh chan struct{}
+}
+
+// NewPersistentShovelPair makes a supervisor that dials through dialA
+// and dialB. Call Start to begin connecting.
+func NewPersistentShovelPair(dialA, dialB func() (io.ReadWriteCloser, error)) *PersistentShovelPair {
+	return &PersistentShovelPair{
+		DialA:   dialA,
+		DialB:   dialB,
+		Halt:    ssh.NewHalter(),
+		resetCh: make(chan struct{}, 1),
+	}
+}
+
+// Start launches the supervisor goroutine.
+func (p *PersistentShovelPair) Start() {
+	go p.run()
+}
+
+// Stop asks the supervisor to stop reconnecting, tearing down any
+// in-flight pair, and waits until it has.
+func (p *PersistentShovelPair) Stop() {
+	p.Halt.RequestStop()
+	<-p.Halt.DoneChan()
+}
+
+// Reset forces an immediate reconnect attempt, skipping whatever
+// backoff delay is currently pending. Callers watching an external
+// event (network back up, sshd reachable again) can use it instead of
+// waiting out a backoff computed for conditions that no longer apply.
+func (p *PersistentShovelPair) Reset() {
+	select {
+	case p.resetCh <- struct{}{}:
+	default:
+	}
+}
+
+// BackoffState returns a snapshot of the current reconnect backoff.
+func (p *PersistentShovelPair) BackoffState() BackoffState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state
+}
+
+func (p *PersistentShovelPair) backoffBase() time.Duration {
+	if p.BackoffBase > 0 {
+		return p.BackoffBase
+	}
+	return defaultBackoffBase
+}
+
+func (p *PersistentShovelPair) backoffCap() time.Duration {
+	if p.BackoffCap > 0 {
+		return p.BackoffCap
+	}
+	return defaultBackoffCap
+}
+
+func (p *PersistentShovelPair) minConnDuration() time.Duration {
+	if p.MinConnDuration > 0 {
+		return p.MinConnDuration
+	}
+	return defaultMinConnDuration
+}
+
+// nextDelay computes the truncated exponential backoff, with +/-20%
+// jitter, for the given consecutive failure count (must be >= 1).
+func (p *PersistentShovelPair) nextDelay(failures int) time.Duration {
+	capped := p.backoffCap()
+	d := p.backoffBase() << uint(failures-1)
+	if d <= 0 || d > capped {
+		d = capped
+	}
+	jitter := 1 + (rand.Float64()*2-1)*backoffJitterFrac
+	return time.Duration(float64(d) * jitter)
+}
+
+func (p *PersistentShovelPair) run() {
+	defer p.Halt.MarkDone()
+	p.Halt.MarkReady()
+
+	for {
+		select {
+		case <-p.Halt.ReqStopChan():
+			return
+		default:
+		}
+
+		a, errA := p.DialA()
+		var b io.ReadWriteCloser
+		var errB error
+		if errA == nil {
+			b, errB = p.DialB()
+		}
+		if err := firstErr(errA, errB); err != nil {
+			if a != nil {
+				a.Close()
+			}
+			if !p.recordFailureAndWait(err) {
+				return
+			}
+			continue
+		}
+
+		pair := newShovelPair(p.DoLog)
+		pair.MaxWaitForSecondStream = p.MaxWaitForSecondStream
+		connectedAt := time.Now()
+		pair.Start(a, b, p.AbLabel, p.BaLabel)
+
+		select {
+		case <-pair.Halt.DoneChan():
+			if up := time.Since(connectedAt); up >= p.minConnDuration() {
+				p.recordSuccess()
+			} else if !p.recordFailureAndWait(fmt.Errorf("connection dropped after %s, below MinConnDuration", up)) {
+				return
+			}
+		case <-p.Halt.ReqStopChan():
+			pair.Stop()
+			return
+		}
+	}
+}
+
+func firstErr(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *PersistentShovelPair) recordSuccess() {
+	p.mu.Lock()
+	p.state = BackoffState{}
+	p.mu.Unlock()
+}
+
+// recordFailureAndWait records err, advances the backoff, and sleeps
+// for the resulting delay (preemptible by Reset or Stop). It returns
+// false if the supervisor should give up -- Stop() was called, or
+// MaxConsecutiveFailures was exceeded.
+func (p *PersistentShovelPair) recordFailureAndWait(err error) bool {
+	p.mu.Lock()
+	p.state.ConsecutiveFailures++
+	p.state.LastErr = err
+	failures := p.state.ConsecutiveFailures
+	if p.MaxConsecutiveFailures > 0 && failures > p.MaxConsecutiveFailures {
+		p.mu.Unlock()
+		return false
+	}
+	delay := p.nextDelay(failures)
+	p.state.NextDelay = delay
+	p.mu.Unlock()
+
+	select {
+	case <-time.After(delay):
+	case <-p.resetCh:
+	case <-p.Halt.ReqStopChan():
+		return false
+	}
+	return true
+}
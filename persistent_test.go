@@ -0,0 +1,111 @@
+package sshego
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var errTest = errors.New("boom")
+
+func TestBackoffDefaults(t *testing.T) {
+	p := &PersistentShovelPair{}
+	if got := p.backoffBase(); got != defaultBackoffBase {
+		t.Fatalf("expected default base %s, got %s", defaultBackoffBase, got)
+	}
+	if got := p.backoffCap(); got != defaultBackoffCap {
+		t.Fatalf("expected default cap %s, got %s", defaultBackoffCap, got)
+	}
+	if got := p.minConnDuration(); got != defaultMinConnDuration {
+		t.Fatalf("expected default MinConnDuration %s, got %s", defaultMinConnDuration, got)
+	}
+}
+
+func TestNextDelayWithinJitterBounds(t *testing.T) {
+	p := &PersistentShovelPair{
+		BackoffBase: 100 * time.Millisecond,
+		BackoffCap:  1 * time.Second,
+	}
+	cases := []struct {
+		failures int
+		target   time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{10, 1 * time.Second}, // truncated by BackoffCap
+	}
+	for _, c := range cases {
+		low := time.Duration(float64(c.target) * (1 - backoffJitterFrac))
+		high := time.Duration(float64(c.target) * (1 + backoffJitterFrac))
+		for i := 0; i < 20; i++ {
+			d := p.nextDelay(c.failures)
+			if d < low || d > high {
+				t.Fatalf("failures=%d: delay %s outside [%s,%s] (target %s)", c.failures, d, low, high, c.target)
+			}
+		}
+	}
+}
+
+func TestRecordFailureAndWaitStopsAtMax(t *testing.T) {
+	p := NewPersistentShovelPair(nil, nil)
+	p.BackoffBase = time.Millisecond
+	p.BackoffCap = time.Millisecond
+	p.MaxConsecutiveFailures = 2
+
+	if !p.recordFailureAndWait(errTest) {
+		t.Fatal("expected the first consecutive failure to retry")
+	}
+	if !p.recordFailureAndWait(errTest) {
+		t.Fatal("expected the second consecutive failure to retry")
+	}
+	if p.recordFailureAndWait(errTest) {
+		t.Fatal("expected the third consecutive failure to give up")
+	}
+
+	state := p.BackoffState()
+	if state.ConsecutiveFailures != 3 {
+		t.Fatalf("expected 3 recorded failures, got %d", state.ConsecutiveFailures)
+	}
+	if state.LastErr != errTest {
+		t.Fatalf("expected LastErr to be recorded, got %v", state.LastErr)
+	}
+}
+
+func TestResetPreemptsBackoffWait(t *testing.T) {
+	p := NewPersistentShovelPair(nil, nil)
+	p.BackoffBase = time.Hour
+	p.BackoffCap = time.Hour
+
+	done := make(chan bool, 1)
+	go func() {
+		done <- p.recordFailureAndWait(errTest)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	p.Reset()
+
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Fatal("expected Reset to let the retry proceed, not give up")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Reset did not preempt the pending backoff wait")
+	}
+}
+
+func TestRecordSuccessClearsBackoffState(t *testing.T) {
+	p := NewPersistentShovelPair(nil, nil)
+	p.BackoffBase = time.Millisecond
+	p.BackoffCap = time.Millisecond
+
+	p.recordFailureAndWait(errTest)
+	if p.BackoffState().ConsecutiveFailures == 0 {
+		t.Fatal("expected a recorded failure before recordSuccess")
+	}
+
+	p.recordSuccess()
+	if state := p.BackoffState(); state.ConsecutiveFailures != 0 || state.LastErr != nil {
+		t.Fatalf("expected recordSuccess to reset the backoff state, got %+v", state)
+	}
+}
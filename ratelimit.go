@@ -0,0 +1,222 @@
+package sshego
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a minimal, dependency-free bytes/sec token bucket with
+// a burst cap. It is safe for concurrent use, and SetRate may be called
+// while a Take is in flight: the next refill picks up the new rate
+// immediately, which is what lets shovel.SetRate apply to a shovel that
+// is already copying.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes/sec; <= 0 means unlimited
+	burst  float64 // bytes
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket makes a bucket starting full, so the first burst of
+// traffic up to burst bytes is never delayed.
+func newTokenBucket(ratePerSec float64, burst int64) *tokenBucket {
+	return &tokenBucket{
+		rate:   ratePerSec,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// SetRate live-updates the bucket's rate and burst. A non-positive
+// ratePerSec disables limiting entirely.
+func (tb *tokenBucket) SetRate(ratePerSec float64, burst int64) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refillLocked()
+	tb.rate = ratePerSec
+	tb.burst = float64(burst)
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+}
+
+// Enabled reports whether the bucket is currently limiting.
+func (tb *tokenBucket) Enabled() bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return tb.rate > 0
+}
+
+// Burst returns the current burst size in bytes.
+func (tb *tokenBucket) Burst() int64 {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return int64(tb.burst)
+}
+
+// refillLocked must be called with tb.mu held.
+func (tb *tokenBucket) refillLocked() {
+	now := time.Now()
+	if tb.rate > 0 {
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+		if tb.tokens > tb.burst {
+			tb.tokens = tb.burst
+		}
+	}
+	tb.last = now
+}
+
+// Take blocks until n bytes of budget are available, deducts them, and
+// returns how long it slept. A non-positive rate never blocks. Callers
+// must first clamp n to Burst() or Take can never be satisfied.
+func (tb *tokenBucket) Take(n int) time.Duration {
+	start := time.Now()
+	for {
+		tb.mu.Lock()
+		tb.refillLocked()
+		if tb.rate <= 0 || tb.tokens >= float64(n) {
+			tb.tokens -= float64(n)
+			tb.mu.Unlock()
+			return time.Since(start)
+		}
+		wait := time.Duration((float64(n) - tb.tokens) / tb.rate * float64(time.Second))
+		tb.mu.Unlock()
+		time.Sleep(wait)
+	}
+}
+
+// Refund returns n bytes of budget that were reserved via Take but
+// never actually consumed (a short read), capped at the burst size.
+func (tb *tokenBucket) Refund(n int) {
+	if n <= 0 {
+		return
+	}
+	tb.mu.Lock()
+	tb.refillLocked()
+	tb.tokens += float64(n)
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.mu.Unlock()
+}
+
+// ewmaAlpha weights each new instantaneous-throughput sample against
+// the running average kept in shovelMetrics.ewma (reported as
+// ShovelStats.ThroughputEWMA).
+const ewmaAlpha = 0.2
+
+// ShovelStats is a point-in-time snapshot of one shovel direction's
+// throughput, returned by shovel.Stats(). It is meant to be cheap
+// enough to sample on every Prometheus scrape.
+type ShovelStats struct {
+	BytesCopied    int64
+	ThroughputEWMA float64 // bytes/sec
+	PauseDuration  time.Duration
+	LastErr        error
+}
+
+// shovelMetrics accumulates the counters behind ShovelStats. All access
+// goes through mu so Stats() can be read safely while a copy is
+// in-flight on another goroutine.
+type shovelMetrics struct {
+	mu         sync.Mutex
+	bytes      int64
+	ewma       float64
+	lastSample time.Time
+	pause      time.Duration
+	lastErr    error
+}
+
+// record folds in the result of one Read: n bytes observed over the
+// time since the previous sample, and (if non-nil and not io.EOF) err
+// as the shovel's most recent error.
+func (m *shovelMetrics) record(n int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n > 0 {
+		now := time.Now()
+		m.bytes += int64(n)
+		if !m.lastSample.IsZero() {
+			if elapsed := now.Sub(m.lastSample).Seconds(); elapsed > 0 {
+				sample := float64(n) / elapsed
+				if m.ewma == 0 {
+					m.ewma = sample
+				} else {
+					m.ewma = ewmaAlpha*sample + (1-ewmaAlpha)*m.ewma
+				}
+			}
+		}
+		m.lastSample = now
+	}
+	if err != nil && err != io.EOF {
+		m.lastErr = err
+	}
+}
+
+func (m *shovelMetrics) addPause(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	m.mu.Lock()
+	m.pause += d
+	m.mu.Unlock()
+}
+
+func (m *shovelMetrics) snapshot() ShovelStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return ShovelStats{
+		BytesCopied:    m.bytes,
+		ThroughputEWMA: m.ewma,
+		PauseDuration:  m.pause,
+		LastErr:        m.lastErr,
+	}
+}
+
+// meteredReader enforces tb's rate cap (if any) on r and folds every
+// Read into m. It is the innermost wrapping shovel.Start applies, so
+// the existing DoLog TeeReader still tees exactly what io.Copy sees.
+type meteredReader struct {
+	r  io.Reader
+	tb *tokenBucket
+	m  *shovelMetrics
+}
+
+func (mr *meteredReader) Read(p []byte) (int, error) {
+	limited := mr.tb.Enabled()
+	if limited {
+		if max := int(mr.tb.Burst()); max > 0 && len(p) > max {
+			p = p[:max]
+		}
+	}
+	requested := len(p)
+	if limited && requested > 0 {
+		mr.m.addPause(mr.tb.Take(requested))
+	}
+
+	n, err := mr.r.Read(p)
+
+	// A short read (the common case for a socket delivering discrete
+	// packets) must only be charged for what it actually returned, or
+	// real throughput ends up far below ratePerSec/burst -- refund the
+	// difference between the reservation and the actual bytes read.
+	if limited {
+		if unused := requested - n; unused > 0 {
+			mr.tb.Refund(unused)
+		}
+	}
+
+	mr.m.record(n, err)
+	return n, err
+}
+
+// meteredReadCloser pairs a meteredReader with the original reader's
+// Closer, so shovel.Start can reassign r, an io.ReadCloser, to the
+// metered reader and Close still closes the original reader.
+type meteredReadCloser struct {
+	io.Reader
+	io.Closer
+}
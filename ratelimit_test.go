@@ -0,0 +1,100 @@
+package sshego
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketTakeRespectsRate(t *testing.T) {
+	tb := newTokenBucket(100, 100) // 100 bytes/sec, burst 100
+
+	// draining the initial burst should be free
+	if d := tb.Take(100); d > 10*time.Millisecond {
+		t.Fatalf("expected the initial burst to be free, slept %s", d)
+	}
+
+	// the bucket is now empty; one more byte must wait ~1/100s to refill
+	start := time.Now()
+	tb.Take(1)
+	if elapsed := time.Since(start); elapsed < 5*time.Millisecond {
+		t.Fatalf("expected Take to wait for refill, only waited %s", elapsed)
+	}
+}
+
+func TestTokenBucketSetRateLiveUpdate(t *testing.T) {
+	tb := newTokenBucket(1, 1) // effectively frozen: 1 byte/sec, burst 1
+	tb.Take(1)                 // drain the single token
+
+	tb.SetRate(1e6, 1e6) // raise the rate before the next Take
+	start := time.Now()
+	tb.Take(1000)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("expected SetRate to take effect immediately, waited %s", elapsed)
+	}
+}
+
+func TestTokenBucketDisabledByNonPositiveRate(t *testing.T) {
+	tb := newTokenBucket(0, 0)
+	if tb.Enabled() {
+		t.Fatal("expected a non-positive rate to disable the bucket")
+	}
+
+	start := time.Now()
+	tb.Take(1 << 20) // a megabyte should be free when limiting is off
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Fatalf("expected an unlimited bucket not to block, waited %s", elapsed)
+	}
+}
+
+// shortReader always returns fewer bytes than requested, the common
+// case for a socket delivering discrete packets.
+type shortReader struct {
+	remaining int
+}
+
+func (sr *shortReader) Read(p []byte) (int, error) {
+	if sr.remaining <= 0 {
+		return 0, io.EOF
+	}
+	n := 1
+	if len(p) < n {
+		n = len(p)
+	}
+	sr.remaining -= n
+	return n, nil
+}
+
+// TestMeteredReaderChargesActualBytesNotRequestedLength guards against
+// charging a full clamped-request-sized debit for every short read: a
+// connection trickling single bytes should still be able to make many
+// Reads per second, not one per second at a byte/sec rate.
+func TestMeteredReaderChargesActualBytesNotRequestedLength(t *testing.T) {
+	tb := newTokenBucket(1, 64) // 1 byte/sec, burst 64 -- one big reservation
+	mr := &meteredReader{r: &shortReader{remaining: 10}, tb: tb, m: &shovelMetrics{}}
+
+	buf := make([]byte, 32)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if _, err := mr.Read(buf); err != nil {
+			t.Fatalf("unexpected error on read %d: %v", i, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("expected 10 one-byte short reads to stay within the 64-byte burst, took %s", elapsed)
+	}
+}
+
+func TestShovelMetricsRecordTracksBytesAndLastErr(t *testing.T) {
+	m := &shovelMetrics{}
+	m.record(10, nil)
+	m.record(20, errTest)
+
+	got := m.snapshot()
+	if got.BytesCopied != 30 {
+		t.Fatalf("expected 30 bytes recorded, got %d", got.BytesCopied)
+	}
+	if got.LastErr != errTest {
+		t.Fatalf("expected LastErr to be recorded, got %v", got.LastErr)
+	}
+}
@@ -1,8 +1,12 @@
 package sshego
 
 import (
+	"context"
 	"io"
 	"os"
+	"runtime/debug"
+	"sync"
+	"time"
 
 	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
 )
@@ -18,6 +22,17 @@ type shovel struct {
 	DoLog     bool
 	LogReads  io.Writer
 	LogWrites io.Writer
+
+	// HalfClosed is set once the read side has hit a clean io.EOF and the
+	// write side has been half-closed (or would have been, had it supported
+	// CloseWrite) in response, rather than fully closed. shovelPair uses
+	// this to tell a natural, one-directional finish apart from an abrupt
+	// Stop(), since only the former deserves a grace period for the peer
+	// direction to drain.
+	HalfClosed bool
+
+	limiter *tokenBucket
+	metrics *shovelMetrics
 }
 
 // make a new Shovel
@@ -27,9 +42,24 @@ func newShovel(doLog bool) *shovel {
 		DoLog:     doLog,
 		LogReads:  os.Stdout,
 		LogWrites: os.Stdout,
+		limiter:   newTokenBucket(0, 0),
+		metrics:   &shovelMetrics{},
 	}
 }
 
+// SetRate live-updates this shovel's throughput cap to ratePerSec
+// bytes/sec with the given burst in bytes. A non-positive ratePerSec
+// disables limiting. It is safe to call before or after Start; a
+// change made mid-transfer takes effect on the very next Read.
+func (s *shovel) SetRate(ratePerSec float64, burst int64) {
+	s.limiter.SetRate(ratePerSec, burst)
+}
+
+// Stats returns a snapshot of this shovel's throughput counters.
+func (s *shovel) Stats() ShovelStats {
+	return s.metrics.snapshot()
+}
+
 type readerNilCloser struct{ io.Reader }
 
 func (rc *readerNilCloser) Close() error { return nil }
@@ -38,6 +68,25 @@ type writerNilCloser struct{ io.Writer }
 
 func (wc *writerNilCloser) Close() error { return nil }
 
+// halfCloseWriter is implemented by connections (e.g. *net.TCPConn,
+// *net.UnixConn) that can shut down their write side while leaving the
+// read side open, so a peer reading to EOF still sees a clean end of
+// stream without the whole connection being torn down.
+type halfCloseWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite half-closes w if it implements halfCloseWriter, and is a
+// no-op fallback otherwise. It never fully closes w, so in-flight reads
+// on the other direction are left alone.
+func closeWrite(w io.Writer) error {
+	hc, ok := w.(halfCloseWriter)
+	if !ok {
+		return nil
+	}
+	return hc.CloseWrite()
+}
+
 // Start starts the shovel doing an io.Copy from r to w. The
 // goroutine that is running the copy will close the Ready
 // channel just before starting the io.Copy. The
@@ -45,6 +94,19 @@ func (wc *writerNilCloser) Close() error { return nil }
 // was shut down.
 func (s *shovel) Start(w io.WriteCloser, r io.ReadCloser, label string) {
 
+	// realR/realW are the caller's actual reader/writer, kept aside so
+	// that the clean-EOF half-close below, and the ReqStop force-close,
+	// both act on the real thing rather than on the DoLog logging
+	// wrapper: readerNilCloser/writerNilCloser's Close is a no-op, and
+	// neither implements halfCloseWriter.
+	realR := r
+	realW := w
+
+	r = &meteredReadCloser{
+		Reader: &meteredReader{r: r, tb: s.limiter, m: s.metrics},
+		Closer: r,
+	}
+
 	if s.DoLog {
 		// TeeReader returns a Reader that writes to w what it reads from r.
 		// All reads from r performed through it are matched with
@@ -59,6 +121,9 @@ func (s *shovel) Start(w io.WriteCloser, r io.ReadCloser, label string) {
 		var err error
 		var n int64
 		defer func() {
+			if r := recover(); r != nil {
+				CrashHandler(label, r, debug.Stack())
+			}
 			s.Halt.MarkDone()
 			p("shovel %s copied %d bytes before shutting down", label, n)
 		}()
@@ -68,14 +133,28 @@ func (s *shovel) Start(w io.WriteCloser, r io.ReadCloser, label string) {
 			// don't freak out, the network connection got closed most likely.
 			// e.g. read tcp 127.0.0.1:33631: use of closed network connection
 			//panic(fmt.Sprintf("in Shovel '%s', io.Copy failed: %v\n", label, err))
+			s.metrics.record(0, err)
 			return
 		}
+		// r hit a clean EOF. Half-close realW instead of yanking it shut,
+		// so a peer that is still flushing a reply (e.g. an HTTP/1.1
+		// response or an SSH exec channel) isn't truncated.
+		_ = closeWrite(realW)
+		s.HalfClosed = true
 	}()
 	go func() {
+		defer func() {
+			if rec := recover(); rec != nil {
+				CrashHandler(label, rec, debug.Stack())
+			}
+			s.Halt.MarkDone()
+		}()
 		<-s.Halt.ReqStopChan()
-		r.Close() // causes io.Copy to finish
-		w.Close()
-		s.Halt.MarkDone()
+		// Close the real reader/writer, not the DoLog wrappers (whose
+		// Close is a no-op), so io.Copy actually unblocks and the
+		// underlying connection is really torn down.
+		realR.Close()
+		realW.Close()
 	}()
 }
 
@@ -93,6 +172,13 @@ type shovelPair struct {
 	Halt *ssh.Halter
 
 	DoLog bool
+
+	// MaxWaitForSecondStream bounds how long shovelPair waits for the
+	// second direction to finish on its own after the first direction
+	// half-closes on a clean EOF, before forcing both sides fully closed.
+	// The zero value preserves the historical behavior of closing both
+	// sides as soon as either one finishes.
+	MaxWaitForSecondStream time.Duration
 }
 
 // make a new shovelPair
@@ -107,6 +193,66 @@ func newShovelPair(doLog bool) *shovelPair {
 	return pair
 }
 
+// pairRegistryMu guards pairRegistry, the set of shovelPairs currently
+// in flight. A pair is only registered once Start() has run -- and so
+// is guaranteed a monitor goroutine that will eventually close its
+// Halt -- so Stop()/Shutdown() can never hang on an entry here. It
+// exists so a parent Server-level Shutdown can fan out to every
+// forwarding pair it doesn't otherwise keep a reference to -- the same
+// role gliderlabs/ssh's listener/conn tracking plays for
+// net/http.Server.Shutdown.
+var (
+	pairRegistryMu sync.Mutex
+	pairRegistry   = map[*shovelPair]struct{}{}
+)
+
+func registerPair(p *shovelPair) {
+	pairRegistryMu.Lock()
+	pairRegistry[p] = struct{}{}
+	pairRegistryMu.Unlock()
+}
+
+func unregisterPair(p *shovelPair) {
+	pairRegistryMu.Lock()
+	delete(pairRegistry, p)
+	pairRegistryMu.Unlock()
+}
+
+// ShutdownAllPairs calls Shutdown(ctx) on every shovelPair that is
+// still in flight, mirroring how net/http.Server.Shutdown drains its
+// tracked connections. Pairs are shut down concurrently so one pair's
+// natural drain can't eat the shared ctx deadline that the rest are
+// also racing against. It returns the first error seen.
+func ShutdownAllPairs(ctx context.Context) error {
+	pairRegistryMu.Lock()
+	pairs := make([]*shovelPair, 0, len(pairRegistry))
+	for p := range pairRegistry {
+		pairs = append(pairs, p)
+	}
+	pairRegistryMu.Unlock()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for _, p := range pairs {
+		wg.Add(1)
+		go func(p *shovelPair) {
+			defer wg.Done()
+			if err := p.Shutdown(ctx); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(p)
+	}
+	wg.Wait()
+	return firstErr
+}
+
 // Start the pair of shovels. abLabel will label the a<-b shovel. baLabel will
 // label the b<-a shovel.
 func (s *shovelPair) Start(a io.ReadWriteCloser, b io.ReadWriteCloser, abLabel string, baLabel string) {
@@ -115,26 +261,91 @@ func (s *shovelPair) Start(a io.ReadWriteCloser, b io.ReadWriteCloser, abLabel s
 	s.BA.Start(b, a, baLabel)
 	<-s.BA.Halt.ReadyChan()
 	s.Halt.MarkReady()
+	registerPair(s)
 
-	// if one stops, shut down the other
+	// if one stops, shut down the other -- unless it merely half-closed on
+	// a clean EOF, in which case give the peer direction a chance to
+	// drain naturally first.
 	go func() {
 		select {
 		case <-s.Halt.ReqStopChan():
 		case <-s.Halt.DoneChan():
 		case <-s.AB.Halt.ReqStopChan():
 		case <-s.AB.Halt.DoneChan():
+			if s.AB.HalfClosed {
+				s.waitSecondStream(s.BA)
+			}
 		case <-s.BA.Halt.ReqStopChan():
 		case <-s.BA.Halt.DoneChan():
+			if s.BA.HalfClosed {
+				s.waitSecondStream(s.AB)
+			}
 		}
 		s.AB.Stop()
 		s.BA.Stop()
 		s.Halt.RequestStop()
 		s.Halt.MarkDone()
+		unregisterPair(s)
 	}()
 }
 
+// waitSecondStream gives other up to MaxWaitForSecondStream to finish
+// draining on its own before returning to the caller, which will then
+// force both directions closed. A zero MaxWaitForSecondStream returns
+// immediately, preserving the historical close-on-first-finish behavior.
+func (s *shovelPair) waitSecondStream(other *shovel) {
+	if s.MaxWaitForSecondStream <= 0 {
+		return
+	}
+	select {
+	case <-other.Halt.DoneChan():
+	case <-time.After(s.MaxWaitForSecondStream):
+	}
+}
+
 func (s *shovelPair) Stop() {
 	s.Halt.RequestStop()
 	s.AB.Stop()
 	s.BA.Stop()
 }
+
+// Shutdown gracefully stops s, mirroring net/http.Server.Shutdown: it
+// forces nothing closed itself, but waits for the pair to finish as it
+// would without Shutdown, and returns nil once it has. The pair
+// finishes when one direction does, after closing the other direction
+// (straight away, or after the half-close grace period from
+// MaxWaitForSecondStream). If ctx is done first, it falls back to
+// Stop(), force-closing both directions, and returns ctx.Err().
+func (s *shovelPair) Shutdown(ctx context.Context) error {
+	select {
+	case <-s.Halt.DoneChan():
+		return nil
+	case <-ctx.Done():
+		s.Stop()
+		return ctx.Err()
+	}
+}
+
+// ShovelPairStats bundles both directions' throughput snapshots, for
+// callers juggling many forwards and wanting one call per pair.
+type ShovelPairStats struct {
+	AB ShovelStats
+	BA ShovelStats
+}
+
+// Stats returns a snapshot of both directions' throughput counters.
+func (s *shovelPair) Stats() ShovelPairStats {
+	return ShovelPairStats{AB: s.AB.Stats(), BA: s.BA.Stats()}
+}
+
+// SetRateAB live-updates the A->B direction's throughput cap; see
+// shovel.SetRate.
+func (s *shovelPair) SetRateAB(ratePerSec float64, burst int64) {
+	s.AB.SetRate(ratePerSec, burst)
+}
+
+// SetRateBA live-updates the B->A direction's throughput cap; see
+// shovel.SetRate.
+func (s *shovelPair) SetRateBA(ratePerSec float64, burst int64) {
+	s.BA.SetRate(ratePerSec, burst)
+}
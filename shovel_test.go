@@ -0,0 +1,98 @@
+package sshego
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHalfCloseWriter is an io.Writer/io.Closer that also implements
+// halfCloseWriter, so tests can tell a half-close from a full close.
+type fakeHalfCloseWriter struct {
+	mu          sync.Mutex
+	buf         bytes.Buffer
+	closeWriteN int
+	closeN      int
+}
+
+func (w *fakeHalfCloseWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *fakeHalfCloseWriter) CloseWrite() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closeWriteN++
+	return nil
+}
+
+func (w *fakeHalfCloseWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closeN++
+	return nil
+}
+
+func (w *fakeHalfCloseWriter) counts() (closeWriteN, closeN int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.closeWriteN, w.closeN
+}
+
+// TestShovelHalfClosesRealWriterWithDoLog guards against the DoLog
+// logging wrapper swallowing the half-close: with DoLog on, w gets
+// rewrapped in a writerNilCloser/io.MultiWriter that doesn't implement
+// halfCloseWriter, so closeWrite must be called on the original w, not
+// that wrapper.
+func TestShovelHalfClosesRealWriterWithDoLog(t *testing.T) {
+	s := newShovel(true)
+	r := ioutil.NopCloser(strings.NewReader("hello"))
+	w := &fakeHalfCloseWriter{}
+
+	s.Start(w, r, "test")
+
+	select {
+	case <-s.Halt.DoneChan():
+	case <-time.After(2 * time.Second):
+		t.Fatal("shovel did not finish copying")
+	}
+
+	if !s.HalfClosed {
+		t.Fatal("expected HalfClosed to be set after a clean EOF")
+	}
+	if closeWriteN, closeN := w.counts(); closeWriteN != 1 || closeN != 0 {
+		t.Fatalf("expected CloseWrite once and no full Close on the real writer, got CloseWrite=%d Close=%d", closeWriteN, closeN)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if got := w.buf.String(); got != "hello" {
+		t.Fatalf("expected %q copied through, got %q", "hello", got)
+	}
+}
+
+// TestShovelHalfClosesRealWriterWithoutDoLog is the same check with
+// DoLog off, so a regression in the DoLog path doesn't mask a
+// regression in the base path.
+func TestShovelHalfClosesRealWriterWithoutDoLog(t *testing.T) {
+	s := newShovel(false)
+	r := ioutil.NopCloser(strings.NewReader("hello"))
+	w := &fakeHalfCloseWriter{}
+
+	s.Start(w, r, "test")
+
+	select {
+	case <-s.Halt.DoneChan():
+	case <-time.After(2 * time.Second):
+		t.Fatal("shovel did not finish copying")
+	}
+
+	if closeWriteN, _ := w.counts(); closeWriteN != 1 {
+		t.Fatalf("expected CloseWrite once on the real writer, got %d", closeWriteN)
+	}
+}
@@ -0,0 +1,90 @@
+package sshego
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestShovelPairShutdownDrainsCleanly checks the net/http.Server.Shutdown
+// analogue's happy path: once both directions hit a clean EOF on their
+// own, Shutdown returns nil without anyone calling Stop.
+func TestShovelPairShutdownDrainsCleanly(t *testing.T) {
+	aLocal, aRemote := net.Pipe()
+	bLocal, bRemote := net.Pipe()
+
+	pair := newShovelPair(false)
+	pair.Start(aLocal, bLocal, "ab", "ba")
+
+	aRemote.Close()
+	bRemote.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := pair.Shutdown(ctx); err != nil {
+		t.Fatalf("expected a clean drain, got %v", err)
+	}
+}
+
+// TestShovelPairShutdownForceClosesOnCtxExpiry checks the fallback path:
+// when neither direction finishes before ctx expires, Shutdown falls
+// back to Stop(), force-closing both directions, and reports ctx.Err().
+func TestShovelPairShutdownForceClosesOnCtxExpiry(t *testing.T) {
+	aLocal, aRemote := net.Pipe()
+	bLocal, bRemote := net.Pipe()
+	defer aRemote.Close()
+	defer bRemote.Close()
+
+	pair := newShovelPair(false)
+	pair.Start(aLocal, bLocal, "ab", "ba")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err := pair.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected ctx.Err() on expiry, got %v", err)
+	}
+
+	select {
+	case <-pair.Halt.DoneChan():
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected Shutdown's Stop() fallback to have force-closed the pair")
+	}
+}
+
+// TestShutdownAllPairsFansOutToEveryPair registers several pairs and
+// checks that ShutdownAllPairs drains every one of them, not just the
+// first it happens to iterate over.
+func TestShutdownAllPairsFansOutToEveryPair(t *testing.T) {
+	const n = 3
+	pairs := make([]*shovelPair, 0, n)
+	remotes := make([]net.Conn, 0, 2*n)
+
+	for i := 0; i < n; i++ {
+		aLocal, aRemote := net.Pipe()
+		bLocal, bRemote := net.Pipe()
+		pair := newShovelPair(false)
+		pair.Start(aLocal, bLocal, "ab", "ba")
+		pairs = append(pairs, pair)
+		remotes = append(remotes, aRemote, bRemote)
+	}
+	for _, c := range remotes {
+		c.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := ShutdownAllPairs(ctx); err != nil {
+		t.Fatalf("expected every pair to drain cleanly, got %v", err)
+	}
+
+	for i, p := range pairs {
+		select {
+		case <-p.Halt.DoneChan():
+		default:
+			t.Fatalf("pair %d was not shut down by ShutdownAllPairs", i)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+// Package yamux is vendored in-tree, mirroring how xcryptossh is kept
+// under xendor/ elsewhere in this project (no go.mod/go.sum, so every
+// external dependency has to live in the source tree to resolve). It
+// implements the slice of hashicorp/yamux's API that MuxShovel uses --
+// a length-prefixed stream multiplexer over a single
+// io.ReadWriteCloser, with Client/Server session roles and
+// Open/Accept/Close on top -- rather than the full upstream protocol
+// (flow-control windows, pings, half-closed streams).
+package yamux
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// Config mirrors the handful of yamux.Config fields MuxShovel surfaces
+// as MuxOptions.
+type Config struct {
+	KeepAliveInterval      time.Duration
+	ConnectionWriteTimeout time.Duration
+	AcceptBacklog          int
+	EnableKeepAlive        bool
+}
+
+// DefaultConfig returns yamux's usual defaults.
+func DefaultConfig() *Config {
+	return &Config{
+		AcceptBacklog:          256,
+		EnableKeepAlive:        true,
+		KeepAliveInterval:      30 * time.Second,
+		ConnectionWriteTimeout: 10 * time.Second,
+	}
+}
+
+const (
+	frameOpen byte = iota
+	frameData
+	frameClose
+)
+
+// frameHeaderLen is 1 byte type + 4 bytes stream ID + 4 bytes length.
+const frameHeaderLen = 9
+
+// Session multiplexes many Streams over a single underlying conn. One
+// side of a conn must be created with Client, the other with Server,
+// so stream IDs (odd for the client, even for the server) never
+// collide without the two sides needing to coordinate.
+type Session struct {
+	conn   io.ReadWriteCloser
+	config *Config
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+
+	writeMu sync.Mutex
+
+	acceptCh  chan *Stream
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+// Client wraps conn as the session's client side.
+func Client(conn io.ReadWriteCloser, config *Config) (*Session, error) {
+	return newSession(conn, config, true), nil
+}
+
+// Server wraps conn as the session's server side.
+func Server(conn io.ReadWriteCloser, config *Config) (*Session, error) {
+	return newSession(conn, config, false), nil
+}
+
+func newSession(conn io.ReadWriteCloser, config *Config, client bool) *Session {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	nextID := uint32(2)
+	if client {
+		nextID = 1
+	}
+	s := &Session{
+		conn:     conn,
+		config:   config,
+		streams:  make(map[uint32]*Stream),
+		nextID:   nextID,
+		acceptCh: make(chan *Stream, config.AcceptBacklog),
+		closeCh:  make(chan struct{}),
+	}
+	go s.recvLoop()
+	return s
+}
+
+// Open starts a new logical stream to the peer session.
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	id := s.nextID
+	s.nextID += 2
+	str := newStream(s, id)
+	s.streams[id] = str
+	s.mu.Unlock()
+
+	if err := s.writeFrame(frameOpen, id, nil); err != nil {
+		return nil, err
+	}
+	return str, nil
+}
+
+// Accept blocks until the peer session opens a new logical stream, or
+// the session closes.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case str := <-s.acceptCh:
+		return str, nil
+	case <-s.closeCh:
+		return nil, io.ErrClosedPipe
+	}
+}
+
+// NumStreams reports how many logical streams are currently open.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// CloseChan returns a channel that's closed once the session (and
+// every stream on it) has torn down.
+func (s *Session) CloseChan() <-chan struct{} {
+	return s.closeCh
+}
+
+// Close tears down the session, closing every open stream and the
+// underlying conn. It is safe to call more than once.
+func (s *Session) Close() error {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream)
+		s.mu.Unlock()
+		for _, str := range streams {
+			str.forceClose()
+		}
+		s.conn.Close()
+		close(s.closeCh)
+	})
+	return nil
+}
+
+func (s *Session) writeFrame(typ byte, id uint32, payload []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	hdr := make([]byte, frameHeaderLen)
+	hdr[0] = typ
+	binary.BigEndian.PutUint32(hdr[1:5], id)
+	binary.BigEndian.PutUint32(hdr[5:9], uint32(len(payload)))
+	if _, err := s.conn.Write(hdr); err != nil {
+		return err
+	}
+	if len(payload) > 0 {
+		if _, err := s.conn.Write(payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recvLoop demultiplexes incoming frames onto their Stream until the
+// conn errors out, at which point it tears the whole session down.
+func (s *Session) recvLoop() {
+	defer s.Close()
+	hdr := make([]byte, frameHeaderLen)
+	for {
+		if _, err := io.ReadFull(s.conn, hdr); err != nil {
+			return
+		}
+		typ := hdr[0]
+		id := binary.BigEndian.Uint32(hdr[1:5])
+		length := binary.BigEndian.Uint32(hdr[5:9])
+
+		var payload []byte
+		if length > 0 {
+			payload = make([]byte, length)
+			if _, err := io.ReadFull(s.conn, payload); err != nil {
+				return
+			}
+		}
+
+		switch typ {
+		case frameOpen:
+			str := newStream(s, id)
+			s.mu.Lock()
+			s.streams[id] = str
+			s.mu.Unlock()
+			select {
+			case s.acceptCh <- str:
+			case <-s.closeCh:
+				return
+			}
+		case frameData:
+			s.mu.Lock()
+			str := s.streams[id]
+			s.mu.Unlock()
+			if str != nil {
+				str.pushData(payload)
+			}
+		case frameClose:
+			s.mu.Lock()
+			str := s.streams[id]
+			delete(s.streams, id)
+			s.mu.Unlock()
+			if str != nil {
+				str.remoteClosed()
+			}
+		}
+	}
+}
+
+// Stream is one logical bidirectional connection multiplexed over a
+// Session. It implements io.ReadWriteCloser.
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	buf       []byte
+	closed    bool
+	remoteEOF bool
+}
+
+func newStream(sess *Session, id uint32) *Stream {
+	st := &Stream{id: id, sess: sess}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+func (st *Stream) pushData(p []byte) {
+	st.mu.Lock()
+	st.buf = append(st.buf, p...)
+	st.mu.Unlock()
+	st.cond.Broadcast()
+}
+
+func (st *Stream) remoteClosed() {
+	st.mu.Lock()
+	st.remoteEOF = true
+	st.mu.Unlock()
+	st.cond.Broadcast()
+}
+
+func (st *Stream) forceClose() {
+	st.mu.Lock()
+	st.closed = true
+	st.mu.Unlock()
+	st.cond.Broadcast()
+}
+
+// Read blocks until data, EOF, or Close.
+func (st *Stream) Read(p []byte) (int, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for len(st.buf) == 0 && !st.remoteEOF && !st.closed {
+		st.cond.Wait()
+	}
+	if len(st.buf) == 0 {
+		if st.closed {
+			return 0, io.ErrClosedPipe
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, st.buf)
+	st.buf = st.buf[n:]
+	return n, nil
+}
+
+// Write sends p as one data frame.
+func (st *Stream) Write(p []byte) (int, error) {
+	st.mu.Lock()
+	closed := st.closed
+	st.mu.Unlock()
+	if closed {
+		return 0, io.ErrClosedPipe
+	}
+	if err := st.sess.writeFrame(frameData, st.id, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close closes this stream only; other streams on the same Session
+// are unaffected.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	st.mu.Unlock()
+	st.cond.Broadcast()
+
+	st.sess.mu.Lock()
+	delete(st.sess.streams, st.id)
+	st.sess.mu.Unlock()
+
+	return st.sess.writeFrame(frameClose, st.id, nil)
+}